@@ -0,0 +1,266 @@
+// Package client is a reusable WebSocket client for the chat server in
+// golang/main.go. It owns reconnect and heartbeat so callers (the load
+// tester, future bots/integration tests) don't have to reimplement
+// backoff and ping/pong bookkeeping themselves.
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	DefaultReconnectInterval    = 500 * time.Millisecond
+	DefaultMaxReconnectInterval = 30 * time.Second
+	defaultPingPeriod           = 30 * time.Second
+	defaultPongWait             = 60 * time.Second
+)
+
+// Message is an incoming frame from the server, decoded only as far as
+// "type" -- callers that need the rest unmarshal Raw themselves.
+type Message struct {
+	Type string
+	Raw  json.RawMessage
+}
+
+// Handler is invoked once per incoming message, on the client's read
+// goroutine. It must not block.
+type Handler func(Message)
+
+// Config controls reconnect/heartbeat timing. The zero value uses the
+// package defaults.
+type Config struct {
+	ReconnectInterval    time.Duration
+	MaxReconnectInterval time.Duration
+	PingPeriod           time.Duration
+	PongWait             time.Duration
+}
+
+func (c Config) withDefaults() Config {
+	if c.ReconnectInterval <= 0 {
+		c.ReconnectInterval = DefaultReconnectInterval
+	}
+	if c.MaxReconnectInterval <= 0 {
+		c.MaxReconnectInterval = DefaultMaxReconnectInterval
+	}
+	if c.PingPeriod <= 0 {
+		c.PingPeriod = defaultPingPeriod
+	}
+	if c.PongWait <= 0 {
+		c.PongWait = defaultPongWait
+	}
+	return c
+}
+
+type chatFrame struct {
+	Type    string `json:"type"`
+	Content string `json:"content"`
+}
+
+type typingFrame struct {
+	Type     string `json:"type"`
+	IsTyping bool   `json:"isTyping"`
+}
+
+type pingFrame struct {
+	Type string `json:"type"`
+}
+
+// Client is a single reconnecting connection to the chat server. On any
+// read/write error it redials with jittered exponential backoff between
+// ReconnectInterval and MaxReconnectInterval, and keeps sending its own
+// app-level pings on PingPeriod to mirror the server's heartbeat.
+type Client struct {
+	url string
+	cfg Config
+
+	connMu sync.Mutex
+	conn   *websocket.Conn
+
+	handlerMu sync.Mutex
+	onMsg     Handler
+
+	done     chan struct{}
+	closeOne sync.Once
+}
+
+// Dial connects to wsURL and starts the read/reconnect/heartbeat loops
+// in the background. Register OnMessage before traffic you care about
+// arrives, since frames received before a handler is set are dropped.
+func Dial(wsURL string, cfg Config) (*Client, error) {
+	c := &Client{
+		url:  wsURL,
+		cfg:  cfg.withDefaults(),
+		done: make(chan struct{}),
+	}
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
+	go c.readLoop()
+	go c.pingLoop()
+	return c, nil
+}
+
+// OnMessage registers the handler invoked for every decoded frame.
+func (c *Client) OnMessage(h Handler) {
+	c.handlerMu.Lock()
+	c.onMsg = h
+	c.handlerMu.Unlock()
+}
+
+func (c *Client) SendChat(content string) error {
+	return c.writeJSON(chatFrame{Type: "chat", Content: content})
+}
+
+func (c *Client) SendTyping(isTyping bool) error {
+	return c.writeJSON(typingFrame{Type: "typing", IsTyping: isTyping})
+}
+
+func (c *Client) SendPing() error {
+	return c.writeJSON(pingFrame{Type: "ping"})
+}
+
+// ForceReconnect closes the current underlying connection so the read
+// loop treats it as a failure and redials with backoff, without
+// tearing the Client down. Useful for exercising reconnect behaviour
+// under load without an actual network blip.
+func (c *Client) ForceReconnect() {
+	c.connMu.Lock()
+	conn := c.conn
+	c.connMu.Unlock()
+	if conn != nil {
+		_ = conn.Close()
+	}
+}
+
+// Close stops the background loops and closes the underlying socket.
+// Safe to call more than once.
+func (c *Client) Close() error {
+	var err error
+	c.closeOne.Do(func() {
+		close(c.done)
+		c.connMu.Lock()
+		if c.conn != nil {
+			err = c.conn.Close()
+		}
+		c.connMu.Unlock()
+	})
+	return err
+}
+
+func (c *Client) connect() error {
+	conn, _, err := websocket.DefaultDialer.Dial(c.url, nil)
+	if err != nil {
+		return err
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(c.cfg.PongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(c.cfg.PongWait))
+	})
+
+	c.connMu.Lock()
+	c.conn = conn
+	c.connMu.Unlock()
+	return nil
+}
+
+func (c *Client) writeJSON(v interface{}) error {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if c.conn == nil {
+		return fmt.Errorf("client: not connected")
+	}
+	return c.conn.WriteJSON(v)
+}
+
+func (c *Client) readLoop() {
+	backoff := c.cfg.ReconnectInterval
+	for {
+		c.connMu.Lock()
+		conn := c.conn
+		c.connMu.Unlock()
+
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			select {
+			case <-c.done:
+				return
+			default:
+			}
+			backoff = c.reconnectWithBackoff(backoff)
+			continue
+		}
+		backoff = c.cfg.ReconnectInterval
+
+		var base struct {
+			Type string `json:"type"`
+		}
+		if json.Unmarshal(data, &base) != nil {
+			continue
+		}
+
+		c.handlerMu.Lock()
+		h := c.onMsg
+		c.handlerMu.Unlock()
+		if h != nil {
+			h(Message{Type: base.Type, Raw: data})
+		}
+	}
+}
+
+// reconnectWithBackoff blocks (unless Close is called) until a new
+// connection is up, doubling backoff on each failed attempt with full
+// jitter, and returns the backoff to use if the next attempt also fails.
+func (c *Client) reconnectWithBackoff(backoff time.Duration) time.Duration {
+	for {
+		select {
+		case <-c.done:
+			return backoff
+		default:
+		}
+
+		sleep := time.Duration(rand.Int63n(int64(backoff) + 1))
+		time.Sleep(sleep)
+
+		if err := c.connect(); err == nil {
+			return c.cfg.ReconnectInterval
+		}
+
+		backoff *= 2
+		if backoff > c.cfg.MaxReconnectInterval {
+			backoff = c.cfg.MaxReconnectInterval
+		}
+	}
+}
+
+func (c *Client) pingLoop() {
+	ticker := time.NewTicker(c.cfg.PingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			// a real WS control ping, so the server's ping handler answers
+			// with a Pong that resets PongWait via our own
+			// SetPongHandler -- the app-level JSON ping alone never
+			// reaches the Pong handler.
+			_ = c.sendControlPing()
+			_ = c.SendPing()
+		}
+	}
+}
+
+func (c *Client) sendControlPing() error {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if c.conn == nil {
+		return fmt.Errorf("client: not connected")
+	}
+	return c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.cfg.PongWait))
+}
@@ -4,16 +4,21 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
-	_ "modernc.org/sqlite" 
+	"github.com/tidwall/wal"
+	_ "modernc.org/sqlite"
 )
 
 
@@ -24,14 +29,345 @@ type User struct {
 	Token    string
 }
 
+// Role is a user's standing within one channel, stored in
+// channel_members -- it's per-channel, not global on the user.
+type Role string
+
+const (
+	RoleOwner    Role = "owner"
+	RoleMember   Role = "member"
+	RoleReadonly Role = "readonly"
+	RoleBanned   Role = "banned"
+)
+
+// ProtocolError, UserError and KickError are the sentinels
+// errorToCloseMessage maps onto WebSocket close codes, mirroring
+// galene's errorToWSCloseMessage. ProtocolError is a malformed/invalid
+// frame, UserError is a rejected-but-otherwise-valid action, KickError
+// is an owner-initiated removal.
+type ProtocolError string
+
+func (e ProtocolError) Error() string { return string(e) }
+
+type UserError string
+
+func (e UserError) Error() string { return string(e) }
+
+type KickError string
+
+func (e KickError) Error() string { return string(e) }
+
+const (
+	writeChBuf   = 64
+	writeTimeout = 10 * time.Second
+	pongWait     = 60 * time.Second
+	pingPeriod   = 30 * time.Second
+)
+
+// rate/size limits, all overridable via env so an operator can tune
+// them without a rebuild.
+var (
+	maxFrameBytes       = envInt64("MAX_FRAME_BYTES", 8*1024)
+	chatRatePerSec      = envFloat("CHAT_RATE_PER_SEC", 5)
+	chatBurst           = envFloat("CHAT_BURST", 10)
+	typingRatePerSec    = envFloat("TYPING_RATE_PER_SEC", 2)
+	typingBurst         = envFloat("TYPING_BURST", 4)
+	channelPublishRate  = envFloat("CHANNEL_PUBLISH_RATE_PER_SEC", 50)
+	channelPublishBurst = envFloat("CHANNEL_PUBLISH_BURST", 100)
+	maxRateViolations   = envInt("MAX_RATE_VIOLATIONS", 5)
+)
+
+func envFloat(key string, def float64) float64 {
+	if v := os.Getenv(key); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f
+		}
+	}
+	return def
+}
+
+func envInt64(key string, def int64) int64 {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return n
+		}
+	}
+	return def
+}
+
+func envInt(key string, def int) int {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+	}
+	return def
+}
+
+// tokenBucket is a hand-rolled limiter: refill tokens/sec up to
+// capacity, one token per allowed frame. Used both per-connection (chat
+// / typing) and per-channel (flood control across all publishers).
+type tokenBucket struct {
+	mu       sync.Mutex
+	tokens   float64
+	capacity float64
+	refill   float64
+	last     time.Time
+}
+
+func newTokenBucket(ratePerSec, burst float64) *tokenBucket {
+	return &tokenBucket{tokens: burst, capacity: burst, refill: ratePerSec, last: time.Now()}
+}
+
+func (b *tokenBucket) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.refill
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// per-channel publish limiter, so one hot channel can't starve others.
+var (
+	channelLimiters   = make(map[string]*tokenBucket)
+	channelLimitersMu sync.Mutex
+)
+
+func channelPublishLimiter(channelID string) *tokenBucket {
+	touchChannel(channelID)
+
+	channelLimitersMu.Lock()
+	defer channelLimitersMu.Unlock()
+	l, ok := channelLimiters[channelID]
+	if !ok {
+		l = newTokenBucket(channelPublishRate, channelPublishBurst)
+		channelLimiters[channelID] = l
+	}
+	return l
+}
+
+// per-channel accepted/rejected/dropped counters, exposed in Prometheus
+// text exposition format at /metrics.
+type channelMetrics struct {
+	accepted uint64
+	rejected uint64
+	dropped  uint64
+}
+
+var (
+	channelMetricsMap = make(map[string]*channelMetrics)
+	channelMetricsMu  sync.Mutex
+)
+
+func (m *channelMetrics) incAccepted() { atomic.AddUint64(&m.accepted, 1) }
+func (m *channelMetrics) incRejected() { atomic.AddUint64(&m.rejected, 1) }
+func (m *channelMetrics) incDropped()  { atomic.AddUint64(&m.dropped, 1) }
+
+func metricsFor(channelID string) *channelMetrics {
+	channelMetricsMu.Lock()
+	defer channelMetricsMu.Unlock()
+	m, ok := channelMetricsMap[channelID]
+	if !ok {
+		m = &channelMetrics{}
+		channelMetricsMap[channelID] = m
+	}
+	return m
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	channelMetricsMu.Lock()
+	defer channelMetricsMu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for channelID, m := range channelMetricsMap {
+		fmt.Fprintf(w, "chat_frames_accepted_total{channel=%q} %d\n", channelID, atomic.LoadUint64(&m.accepted))
+		fmt.Fprintf(w, "chat_frames_rejected_total{channel=%q} %d\n", channelID, atomic.LoadUint64(&m.rejected))
+		fmt.Fprintf(w, "chat_frames_dropped_total{channel=%q} %d\n", channelID, atomic.LoadUint64(&m.dropped))
+	}
+}
+
+// ClientMeta owns the socket from a single writer goroutine; nobody else
+// may call conn.WriteMessage/WriteJSON directly, they enqueue instead.
 type ClientMeta struct {
 	UserID    string
 	Username  string
 	ChannelID string
 	Conn      *websocket.Conn
-	IsAlive   bool
-// per conn mutex
-	WriteMu sync.Mutex 
+	Role      Role
+
+	chatLimiter   *tokenBucket
+	typingLimiter *tokenBucket
+	violations    int32 // atomic; repeated rate-limit hits escalate to a close
+
+	writeCh   chan interface{}
+	pingCh    chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// closeFrame is enqueued on writeCh (never closeCh-style side channel)
+// so a close frame always writes strictly after every message already
+// queued ahead of it -- writeCh's FIFO ordering is what keeps it from
+// ever racing the error frame closeWithError just enqueued.
+type closeFrame struct {
+	msg []byte
+}
+
+func newClientMeta(userID, username, channelID string, conn *websocket.Conn, role Role) *ClientMeta {
+	return &ClientMeta{
+		UserID:        userID,
+		Username:      username,
+		ChannelID:     channelID,
+		Conn:          conn,
+		Role:          role,
+		chatLimiter:   newTokenBucket(chatRatePerSec, chatBurst),
+		typingLimiter: newTokenBucket(typingRatePerSec, typingBurst),
+		writeCh:       make(chan interface{}, writeChBuf),
+		pingCh:        make(chan struct{}, 1),
+		done:          make(chan struct{}),
+	}
+}
+
+// Subscriber is anything that can receive broadcast messages for a
+// channel. *ClientMeta (WebSocket) and sseSubscriber implement it, so
+// channelSubs doesn't need to know about transports. The poll transport
+// has no subscriber: pollHandler reads the channel's WAL directly.
+type Subscriber interface {
+	Send(msg interface{}) error
+}
+
+// Send is a non-blocking enqueue onto the client's writer goroutine. A
+// full channel means the peer isn't draining fast enough; rather than
+// stall the caller (broadcast loop, heartbeat, handler) we drop the
+// message and close the client.
+func (m *ClientMeta) Send(msg interface{}) error {
+	select {
+	case m.writeCh <- msg:
+		return nil
+	case <-m.done:
+		return fmt.Errorf("client closed")
+	default:
+		log.Printf("writeCh overflow, dropping client user=%s", m.UserID)
+		metricsFor(m.ChannelID).incDropped()
+		m.close()
+		return fmt.Errorf("writeCh full, client closed")
+	}
+}
+
+// close stops the writer goroutine and closes the socket. Safe to call
+// more than once (disconnect + read error racing the overflow path).
+func (m *ClientMeta) close() {
+	m.closeOnce.Do(func() {
+		close(m.done)
+		_ = m.Conn.Close()
+	})
+}
+
+// writeLoop is the only goroutine allowed to touch m.Conn for writes. A
+// slow or dead peer only ever blocks this goroutine, never the broadcast
+// fan-out or the heartbeat sweep.
+func (m *ClientMeta) writeLoop() {
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-m.pingCh:
+			_ = m.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := m.Conn.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
+				log.Printf("ping write error user=%s: %v", m.UserID, err)
+				m.close()
+				return
+			}
+		case msg, ok := <-m.writeCh:
+			if !ok {
+				return
+			}
+			if cf, isClose := msg.(closeFrame); isClose {
+				_ = m.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+				_ = m.Conn.WriteControl(websocket.CloseMessage, cf.msg, time.Now().Add(writeTimeout))
+				m.close()
+				return
+			}
+			_ = m.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := m.Conn.WriteJSON(msg); err != nil {
+				log.Printf("write error user=%s: %v", m.UserID, err)
+				m.close()
+				return
+			}
+		}
+	}
+}
+
+// errorToCloseMessage maps a typed error to a WebSocket close frame,
+// mirroring galene's errorToWSCloseMessage.
+func errorToCloseMessage(err error) []byte {
+	code := websocket.CloseInternalServerErr
+	switch err.(type) {
+	case ProtocolError:
+		code = websocket.CloseProtocolError
+	case UserError, KickError:
+		code = websocket.CloseNormalClosure
+	}
+	return websocket.FormatCloseMessage(code, err.Error())
+}
+
+func errorKind(err error) string {
+	switch err.(type) {
+	case ProtocolError:
+		return "protocol"
+	case UserError:
+		return "user"
+	case KickError:
+		return "kick"
+	default:
+		return "internal"
+	}
+}
+
+// closeWithError sends an OutgoingErrorFrame so the client can see why,
+// then queues a close frame behind it on the same writeCh and tears the
+// connection down. Both go through the normal write path, in order, so
+// the close frame can never race ahead of a message already queued in
+// writeCh -- including the error frame this function just enqueued.
+func closeWithError(meta *ClientMeta, err error) {
+	_ = meta.Send(OutgoingErrorFrame{Type: "error", Kind: errorKind(err), Message: err.Error()})
+	_ = meta.Send(closeFrame{msg: errorToCloseMessage(err)})
+}
+
+// rejectRateLimited answers a throttled frame with an advisory retry
+// delay. If countsAgainstConn is set, it also counts the violation
+// against this connection, and once it racks up enough of them the
+// connection is closed with a UserError, so a client that
+// ignores retryAfterMs doesn't get to flood forever. Rejections caused
+// by a channel-wide limiter (shared across every publisher in the
+// channel) must not escalate a single connection, or one hot channel
+// ends up kicking well-behaved members for other people's traffic.
+func rejectRateLimited(meta *ClientMeta, conn *websocket.Conn, ratePerSec float64, countsAgainstConn bool) {
+	metricsFor(meta.ChannelID).incRejected()
+
+	retryAfterMs := int64(1000 / ratePerSec)
+	_ = sendJSON(conn, OutgoingRateLimit{
+		Type:         "error",
+		Message:      "rate_limited",
+		RetryAfterMs: retryAfterMs,
+	})
+
+	if !countsAgainstConn {
+		return
+	}
+	if atomic.AddInt32(&meta.violations, 1) >= int32(maxRateViolations) {
+		closeWithError(meta, UserError("too many rate limit violations"))
+	}
 }
 
 type IncomingBase struct {
@@ -52,6 +388,13 @@ type IncomingPing struct {
 	Type string `json:"type"`
 }
 
+// IncomingModeration backs the owner-only "kick" and "ban" message
+// types; ban additionally persists the target's role as banned.
+type IncomingModeration struct {
+	Type         string `json:"type"`
+	TargetUserID string `json:"targetUserId"`
+}
+
 type OutgoingChat struct {
 	Type      string `json:"type"`
 	ID        string `json:"id"`
@@ -60,6 +403,21 @@ type OutgoingChat struct {
 	Username  string `json:"username"`
 	Content   string `json:"content"`
 	CreatedAt string `json:"createdAt"`
+	Seq       int64  `json:"seq"`
+}
+
+// OutgoingReplay carries a WAL-backed message replayed to a client that
+// reconnected with ?since=<seq>, before it's switched over to live
+// broadcast.
+type OutgoingReplay struct {
+	Type      string `json:"type"`
+	ID        string `json:"id"`
+	ChannelID string `json:"channelId"`
+	UserID    string `json:"userId"`
+	Username  string `json:"username"`
+	Content   string `json:"content"`
+	CreatedAt string `json:"createdAt"`
+	Seq       int64  `json:"seq"`
 }
 
 type OutgoingTyping struct {
@@ -87,6 +445,23 @@ type OutgoingError struct {
 	Message string `json:"message"`
 }
 
+// OutgoingRateLimit is sent instead of OutgoingError when a frame is
+// rejected for being over a rate limit, so well-behaved clients can back
+// off instead of retrying immediately.
+type OutgoingRateLimit struct {
+	Type         string `json:"type"`
+	Message      string `json:"message"`
+	RetryAfterMs int64  `json:"retryAfterMs"`
+}
+
+// OutgoingErrorFrame is sent right before a protocol/user/kick close,
+// so the client can tell the reason apart from a plain OutgoingError.
+type OutgoingErrorFrame struct {
+	Type    string `json:"type"`
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
 type HistoryMessage struct {
 	ID        string `json:"id"`
 	ChannelID string `json:"channelId"`
@@ -94,18 +469,181 @@ type HistoryMessage struct {
 	Username  string `json:"username"`
 	Content   string `json:"content"`
 	CreatedAt string `json:"createdAt"`
+	Seq       int64  `json:"seq"`
 }
 
+// WALEntry is what actually gets appended to a channel's log; history,
+// poll and replay responses are all built from these.
+type WALEntry struct {
+	Seq       int64  `json:"seq"`
+	ID        string `json:"id"`
+	ChannelID string `json:"channelId"`
+	UserID    string `json:"userId"`
+	Username  string `json:"username"`
+	Content   string `json:"content"`
+	CreatedAt string `json:"createdAt"`
+}
+
+func (e WALEntry) toHistoryMessage() HistoryMessage {
+	return HistoryMessage{
+		ID:        e.ID,
+		ChannelID: e.ChannelID,
+		UserID:    e.UserID,
+		Username:  e.Username,
+		Content:   e.Content,
+		CreatedAt: e.CreatedAt,
+		Seq:       e.Seq,
+	}
+}
+
+
+// sqllite setuup -- users/tokens and channel memberships only, messages live in the per-channel WAL
+var (
+	db                      *sql.DB
+	insertUserStmt          *sql.Stmt
+	getUserByTokenStmt      *sql.Stmt
+	getChannelRoleStmt      *sql.Stmt
+	countChannelMembersStmt *sql.Stmt
+	insertChannelMemberStmt *sql.Stmt
+	setChannelRoleStmt      *sql.Stmt
+)
+
+// per-channel WAL registry. Messages get a monotonic int64 seq per
+// channel (the WAL's own index) so clients can resume with ?since=<seq>
+// instead of re-querying a growing history table.
+const walRootDir = "data/wal"
+
+// channelIDPattern restricts channel ids to what's safe to use as a
+// single filesystem path segment (getChannelWAL joins it straight onto
+// walRootDir). Rejects "..", "/" and anything else that could escape
+// walRootDir or collide with reserved names.
+var channelIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+func isValidChannelID(channelID string) bool {
+	return channelIDPattern.MatchString(channelID)
+}
+
+var (
+	channelWALs           = make(map[string]*wal.Log)
+	channelWALsMu         sync.Mutex
+	channelWALAppendMus   = make(map[string]*sync.Mutex)
+	channelWALAppendMusMu sync.Mutex
+)
+
+func getChannelWAL(channelID string) (*wal.Log, error) {
+	touchChannel(channelID)
+
+	channelWALsMu.Lock()
+	defer channelWALsMu.Unlock()
+
+	if l, ok := channelWALs[channelID]; ok {
+		return l, nil
+	}
+	l, err := wal.Open(filepath.Join(walRootDir, channelID), wal.DefaultOptions)
+	if err != nil {
+		return nil, err
+	}
+	channelWALs[channelID] = l
+	return l, nil
+}
+
+// idleChannelTTL bounds how long a channel with no subscribers and no
+// WAL activity keeps its state -- WAL file handle, append mutex,
+// publish limiter, metrics counters -- around. Channel ids are
+// arbitrary client-supplied strings (see isValidChannelID), so without
+// this a client cycling through distinct names grows channelWALs et al.
+// and leaks WAL file descriptors without bound.
+const idleChannelTTL = 10 * time.Minute
 
-// sqllite setuup
 var (
-	db                     *sql.DB
-	insertUserStmt         *sql.Stmt
-	getUserByTokenStmt     *sql.Stmt
-	insertMessageStmt      *sql.Stmt
-	getMessagesForChanStmt *sql.Stmt
+	channelLastActive   = make(map[string]time.Time)
+	channelLastActiveMu sync.Mutex
 )
 
+func touchChannel(channelID string) {
+	channelLastActiveMu.Lock()
+	channelLastActive[channelID] = time.Now()
+	channelLastActiveMu.Unlock()
+}
+
+// reapIdleChannels evicts per-channel state for channels with no
+// subscribers that have been idle for idleChannelTTL. A channel that's
+// subscribed to or published to again afterwards just gets its state
+// recreated lazily, same as a brand-new channel.
+func reapIdleChannels() {
+	cutoff := time.Now().Add(-idleChannelTTL)
+
+	channelLastActiveMu.Lock()
+	var candidates []string
+	for channelID, last := range channelLastActive {
+		if last.Before(cutoff) {
+			candidates = append(candidates, channelID)
+		}
+	}
+	channelLastActiveMu.Unlock()
+
+	for _, channelID := range candidates {
+		channelSubsMu.RLock()
+		subCount := len(channelSubs[channelID])
+		channelSubsMu.RUnlock()
+		if subCount > 0 {
+			continue
+		}
+
+		channelWALsMu.Lock()
+		if l, ok := channelWALs[channelID]; ok {
+			if err := l.Close(); err != nil {
+				log.Printf("close idle WAL channel=%s: %v", channelID, err)
+			}
+			delete(channelWALs, channelID)
+		}
+		channelWALsMu.Unlock()
+
+		channelWALAppendMusMu.Lock()
+		delete(channelWALAppendMus, channelID)
+		channelWALAppendMusMu.Unlock()
+
+		channelLimitersMu.Lock()
+		delete(channelLimiters, channelID)
+		channelLimitersMu.Unlock()
+
+		channelMetricsMu.Lock()
+		delete(channelMetricsMap, channelID)
+		channelMetricsMu.Unlock()
+
+		channelLastActiveMu.Lock()
+		delete(channelLastActive, channelID)
+		channelLastActiveMu.Unlock()
+	}
+}
+
+// startChannelReaper periodically evicts idle per-channel state; see
+// reapIdleChannels.
+func startChannelReaper() {
+	ticker := time.NewTicker(idleChannelTTL / 2)
+	go func() {
+		for range ticker.C {
+			reapIdleChannels()
+		}
+	}()
+}
+
+// appendMutexFor returns the mutex that serializes "read LastIndex, then
+// Write next index" for a single channel's WAL. wal.Log has no atomic
+// append-next-index operation, so every writer needs to hold this for
+// the whole read-then-write sequence.
+func appendMutexFor(channelID string) *sync.Mutex {
+	channelWALAppendMusMu.Lock()
+	defer channelWALAppendMusMu.Unlock()
+
+	if mu, ok := channelWALAppendMus[channelID]; ok {
+		return mu
+	}
+	mu := &sync.Mutex{}
+	channelWALAppendMus[channelID] = mu
+	return mu
+}
+
 func initDB() {
 	var err error
 
@@ -134,13 +672,11 @@ func initDB() {
 		token TEXT NOT NULL UNIQUE
 	);
 
-	CREATE TABLE IF NOT EXISTS messages (
-		id TEXT PRIMARY KEY,
+	CREATE TABLE IF NOT EXISTS channel_members (
 		channel_id TEXT NOT NULL,
 		user_id TEXT NOT NULL,
-		username TEXT NOT NULL,
-		content TEXT NOT NULL,
-		created_at TEXT NOT NULL
+		role TEXT NOT NULL,
+		PRIMARY KEY (channel_id, user_id)
 	);
 	`
 	if _, err := db.Exec(schema); err != nil {
@@ -157,22 +693,27 @@ func initDB() {
 		log.Fatalf("prepare getUserByTokenStmt: %v", err)
 	}
 
-	insertMessageStmt, err = db.Prepare(`
-		INSERT INTO messages (id, channel_id, user_id, username, content, created_at)
-		VALUES (?, ?, ?, ?, ?, ?)`)
+	getChannelRoleStmt, err = db.Prepare(`SELECT role FROM channel_members WHERE channel_id = ? AND user_id = ?`)
+	if err != nil {
+		log.Fatalf("prepare getChannelRoleStmt: %v", err)
+	}
+
+	countChannelMembersStmt, err = db.Prepare(`SELECT COUNT(*) FROM channel_members WHERE channel_id = ?`)
 	if err != nil {
-		log.Fatalf("prepare insertMessageStmt: %v", err)
+		log.Fatalf("prepare countChannelMembersStmt: %v", err)
 	}
 
-	getMessagesForChanStmt, err = db.Prepare(`
-		SELECT id, channel_id, user_id, username, content, created_at
-		FROM messages
-		WHERE channel_id = ?
-		ORDER BY created_at DESC
-		LIMIT ?
+	insertChannelMemberStmt, err = db.Prepare(`INSERT INTO channel_members (channel_id, user_id, role) VALUES (?, ?, ?)`)
+	if err != nil {
+		log.Fatalf("prepare insertChannelMemberStmt: %v", err)
+	}
+
+	setChannelRoleStmt, err = db.Prepare(`
+		INSERT INTO channel_members (channel_id, user_id, role) VALUES (?, ?, ?)
+		ON CONFLICT(channel_id, user_id) DO UPDATE SET role = excluded.role
 	`)
 	if err != nil {
-		log.Fatalf("prepare getMessagesForChanStmt: %v", err)
+		log.Fatalf("prepare setChannelRoleStmt: %v", err)
 	}
 }
 
@@ -188,6 +729,84 @@ func createUser(username string) (*User, error) {
 	return u, nil
 }
 
+func getChannelRole(channelID, userID string) (Role, bool, error) {
+	row := getChannelRoleStmt.QueryRow(channelID, userID)
+	var role string
+	if err := row.Scan(&role); err != nil {
+		if err == sql.ErrNoRows {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	return Role(role), true, nil
+}
+
+func countChannelMembers(channelID string) (int, error) {
+	row := countChannelMembersStmt.QueryRow(channelID)
+	var n int
+	if err := row.Scan(&n); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// membershipMutexFor serializes ensureChannelMembership's "count
+// members, then insert" sequence per channel. Without it two users
+// joining an empty channel concurrently can both read count==0 before
+// either inserts, and both get persisted as owner.
+var (
+	channelMembershipMus   = make(map[string]*sync.Mutex)
+	channelMembershipMusMu sync.Mutex
+)
+
+func membershipMutexFor(channelID string) *sync.Mutex {
+	channelMembershipMusMu.Lock()
+	defer channelMembershipMusMu.Unlock()
+
+	if mu, ok := channelMembershipMus[channelID]; ok {
+		return mu
+	}
+	mu := &sync.Mutex{}
+	channelMembershipMus[channelID] = mu
+	return mu
+}
+
+// ensureChannelMembership looks up the caller's role in channelID,
+// creating a membership row on first join. The first member of a
+// channel becomes its owner; everyone after that joins as a plain
+// member.
+func ensureChannelMembership(channelID, userID string) (Role, error) {
+	mu := membershipMutexFor(channelID)
+	mu.Lock()
+	defer mu.Unlock()
+
+	role, ok, err := getChannelRole(channelID, userID)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return role, nil
+	}
+
+	n, err := countChannelMembers(channelID)
+	if err != nil {
+		return "", err
+	}
+	role = RoleMember
+	if n == 0 {
+		role = RoleOwner
+	}
+	if _, err := insertChannelMemberStmt.Exec(channelID, userID, string(role)); err != nil {
+		return "", err
+	}
+	return role, nil
+}
+
+func setChannelRole(channelID, userID string, role Role) error {
+	_, err := setChannelRoleStmt.Exec(channelID, userID, string(role))
+	return err
+}
+
 func getUserByToken(token string) (*User, error) {
 	row := getUserByTokenStmt.QueryRow(token)
 	u := &User{}
@@ -200,38 +819,170 @@ func getUserByToken(token string) (*User, error) {
 	return u, nil
 }
 
-func insertMessage(channelID, userID, username, content, createdAt string) (string, error) {
-	id := uuid.NewString()
-	if _, err := insertMessageStmt.Exec(id, channelID, userID, username, content, createdAt); err != nil {
-		return "", err
+// appendMessage is the only way a message enters a channel: it assigns
+// the next seq by appending to that channel's WAL. onAppended, if set,
+// runs before the append mutex is released -- callers use it to
+// broadcast the new entry, so a resuming client's subscribeAndReplay
+// snapshot can never land between "seq assigned" and "broadcast sent".
+func appendMessage(channelID, userID, username, content, createdAt string, onAppended func(WALEntry)) (WALEntry, error) {
+	l, err := getChannelWAL(channelID)
+	if err != nil {
+		return WALEntry{}, err
 	}
-	return id, nil
+
+	mu := appendMutexFor(channelID)
+	mu.Lock()
+	defer mu.Unlock()
+
+	last, err := l.LastIndex()
+	if err != nil {
+		return WALEntry{}, err
+	}
+	seq := int64(last) + 1
+
+	entry := WALEntry{
+		Seq:       seq,
+		ID:        uuid.NewString(),
+		ChannelID: channelID,
+		UserID:    userID,
+		Username:  username,
+		Content:   content,
+		CreatedAt: createdAt,
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return WALEntry{}, err
+	}
+	if err := l.Write(uint64(seq), data); err != nil {
+		return WALEntry{}, err
+	}
+	if onAppended != nil {
+		onAppended(entry)
+	}
+	return entry, nil
 }
 
-func getMessagesForChannel(channelID string, limit int) ([]HistoryMessage, error) {
-	rows, err := getMessagesForChanStmt.Query(channelID, limit)
+// recentMessages backs the history endpoint: the last `limit` entries,
+// oldest first.
+func recentMessages(channelID string, limit int) ([]HistoryMessage, error) {
+	l, err := getChannelWAL(channelID)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 
-	var msgs []HistoryMessage
-	for rows.Next() {
-		var m HistoryMessage
-		if err := rows.Scan(&m.ID, &m.ChannelID, &m.UserID, &m.Username, &m.Content, &m.CreatedAt); err != nil {
-			return nil, err
+	last, err := l.LastIndex()
+	if err != nil {
+		return nil, err
+	}
+	if last == 0 {
+		return nil, nil
+	}
+	first, err := l.FirstIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	var start uint64
+	if limit <= 0 || last < uint64(limit) {
+		start = first
+	} else {
+		start = last - uint64(limit) + 1
+		if start < first {
+			start = first
 		}
-		msgs = append(msgs, m)
 	}
-	if err := rows.Err(); err != nil {
+
+	return readWALRange(l, start, last)
+}
+
+// replayMessages backs the poll transport: everything strictly after
+// since, oldest first. The WS resume path uses subscribeAndReplay
+// instead, since it also has to hand off to live broadcast without
+// dropping or duplicating anything in between.
+func replayMessages(channelID string, since int64) ([]HistoryMessage, error) {
+	l, err := getChannelWAL(channelID)
+	if err != nil {
+		return nil, err
+	}
+
+	last, err := l.LastIndex()
+	if err != nil {
+		return nil, err
+	}
+	if last == 0 {
+		return nil, nil
+	}
+	first, err := l.FirstIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	start := uint64(since) + 1
+	if start < first {
+		start = first
+	}
+	if start > last {
+		return nil, nil
+	}
+
+	return readWALRange(l, start, last)
+}
+
+// subscribeAndReplay adds sub to channelSubs and captures the WAL tail
+// to replay under the same appendMutexFor(channelID) lock that guards
+// every append+broadcast (see appendMessage's onAppended). That makes
+// "subscribed" and "replay covers everything up to here" a single
+// atomic snapshot: no append can complete its broadcast in the gap,
+// so a message is never delivered twice (it's either in the replay
+// batch or arrives live, never both) and never dropped.
+func subscribeAndReplay(channelID string, sub Subscriber, since int64) ([]HistoryMessage, error) {
+	l, err := getChannelWAL(channelID)
+	if err != nil {
+		return nil, err
+	}
+
+	mu := appendMutexFor(channelID)
+	mu.Lock()
+	last, err := l.LastIndex()
+	if err != nil {
+		mu.Unlock()
+		return nil, err
+	}
+	addSubscriber(channelID, sub)
+	mu.Unlock()
+
+	if last == 0 {
+		return nil, nil
+	}
+	first, err := l.FirstIndex()
+	if err != nil {
 		return nil, err
 	}
 
-// reveerse res
-	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
-		msgs[i], msgs[j] = msgs[j], msgs[i]
+	start := uint64(since) + 1
+	if start < first {
+		start = first
 	}
+	if start > last {
+		return nil, nil
+	}
+
+	return readWALRange(l, start, last)
+}
 
+func readWALRange(l *wal.Log, start, end uint64) ([]HistoryMessage, error) {
+	msgs := make([]HistoryMessage, 0, end-start+1)
+	for i := start; i <= end; i++ {
+		data, err := l.Read(i)
+		if err != nil {
+			return nil, err
+		}
+		var e WALEntry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, e.toHistoryMessage())
+	}
 	return msgs, nil
 }
 
@@ -241,15 +992,64 @@ var (
 	clients   = make(map[*websocket.Conn]*ClientMeta)
 	clientsMu sync.RWMutex
 
-	channelSubs   = make(map[string]map[*websocket.Conn]struct{})
+	channelSubs   = make(map[string]map[Subscriber]struct{})
 	channelSubsMu sync.RWMutex
 )
 
+// addSubscriber registers sub to receive broadcasts for channelID. Used
+// by the WS and SSE transports so channelSubs stays a single registry
+// for both; the poll transport does not subscribe.
+func addSubscriber(channelID string, sub Subscriber) {
+	touchChannel(channelID)
+
+	channelSubsMu.Lock()
+	subs := channelSubs[channelID]
+	if subs == nil {
+		subs = make(map[Subscriber]struct{})
+		channelSubs[channelID] = subs
+	}
+	subs[sub] = struct{}{}
+	channelSubsMu.Unlock()
+}
+
+func removeSubscriber(channelID string, sub Subscriber) {
+	channelSubsMu.Lock()
+	if subs, ok := channelSubs[channelID]; ok {
+		delete(subs, sub)
+		if len(subs) == 0 {
+			delete(channelSubs, channelID)
+		}
+	}
+	channelSubsMu.Unlock()
+}
+
+// allowedOrigins is populated once from ALLOWED_ORIGINS at startup. An
+// unset/empty env var preserves the old allow-everything behaviour.
+var allowedOrigins = loadAllowedOrigins()
+
+func loadAllowedOrigins() map[string]struct{} {
+	raw := os.Getenv("ALLOWED_ORIGINS")
+	if raw == "" {
+		return nil
+	}
+	set := make(map[string]struct{})
+	for _, o := range strings.Split(raw, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			set[o] = struct{}{}
+		}
+	}
+	return set
+}
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
 	CheckOrigin: func(r *http.Request) bool {
-		return true 
+		if len(allowedOrigins) == 0 {
+			return true
+		}
+		_, ok := allowedOrigins[r.Header.Get("Origin")]
+		return ok
 	},
 }
 
@@ -293,19 +1093,41 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	_ = json.NewEncoder(w).Encode(resp)
 }
 
-func historyHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+// channelsHandler is the single entry point for everything under
+// /channels/{id}/..., dispatching on the trailing path segment so the
+// history, publish, SSE and long-poll endpoints can share one route.
+// The WebSocket is served separately at /ws.
+func channelsHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 4 || parts[1] != "channels" {
+		http.NotFound(w, r)
+		return
+	}
+	channelID := parts[2]
+	if !isValidChannelID(channelID) {
+		http.Error(w, "invalid channel id", http.StatusBadRequest)
 		return
 	}
 
-
-	parts := strings.Split(r.URL.Path, "/")
-	if len(parts) != 4 || parts[1] != "channels" || parts[3] != "history" {
+	switch parts[3] {
+	case "history":
+		historyHandler(w, r, channelID)
+	case "publish":
+		publishHandler(w, r, channelID)
+	case "sse":
+		sseHandler(w, r, channelID)
+	case "poll":
+		pollHandler(w, r, channelID)
+	default:
 		http.NotFound(w, r)
+	}
+}
+
+func historyHandler(w http.ResponseWriter, r *http.Request, channelID string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	channelID := parts[2]
 
 	limitStr := r.URL.Query().Get("limit")
 	limit := 50
@@ -318,9 +1140,9 @@ func historyHandler(w http.ResponseWriter, r *http.Request) {
 		limit = 200
 	}
 
-	msgs, err := getMessagesForChannel(channelID, limit)
+	msgs, err := recentMessages(channelID, limit)
 	if err != nil {
-		log.Printf("getMessagesForChannel error: %v", err)
+		log.Printf("recentMessages error: %v", err)
 		http.Error(w, `{"error":"internal error"}`, http.StatusInternalServerError)
 		return
 	}
@@ -337,7 +1159,220 @@ func historyHandler(w http.ResponseWriter, r *http.Request) {
 	_ = json.NewEncoder(w).Encode(resp)
 }
 
+// publishHandler lets plain HTTP clients (curl, shell scripts) post into
+// a channel without a WebSocket. It accepts a JSON body {"content":"..."}
+// or, for anything else, the raw body as the message text. It enforces
+// the same role/ban checks as the WS path (handleIncomingMessage,
+// wsHandler) and the same channel-wide publish limiter, so the HTTP
+// transport can't be used to bypass a ban or the channel flood cap. The
+// per-connection chat limiter has no counterpart here.
+func publishHandler(w http.ResponseWriter, r *http.Request, channelID string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, `{"error":"missing token"}`, http.StatusUnauthorized)
+		return
+	}
+	user, err := getUserByToken(token)
+	if err != nil {
+		http.Error(w, `{"error":"internal error"}`, http.StatusInternalServerError)
+		return
+	}
+	if user == nil {
+		http.Error(w, `{"error":"invalid token"}`, http.StatusUnauthorized)
+		return
+	}
+
+	role, err := ensureChannelMembership(channelID, user.ID)
+	if err != nil {
+		log.Printf("ensureChannelMembership error: %v", err)
+		http.Error(w, `{"error":"internal error"}`, http.StatusInternalServerError)
+		return
+	}
+	if role == RoleBanned {
+		http.Error(w, `{"error":"banned from this channel"}`, http.StatusForbidden)
+		return
+	}
+	if role == RoleReadonly {
+		http.Error(w, `{"error":"readonly members cannot post"}`, http.StatusForbidden)
+		return
+	}
 
+	if !channelPublishLimiter(channelID).allow() {
+		metricsFor(channelID).incRejected()
+		retryAfterMs := int64(1000 / channelPublishRate)
+		w.Header().Set("Retry-After", strconv.FormatInt(retryAfterMs/1000, 10))
+		w.WriteHeader(http.StatusTooManyRequests)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":        "rate_limited",
+			"retryAfterMs": retryAfterMs,
+		})
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxFrameBytes))
+	if err != nil {
+		http.Error(w, `{"error":"failed to read body"}`, http.StatusBadRequest)
+		return
+	}
+
+	content := strings.TrimSpace(extractPublishContent(body, r.Header.Get("Content-Type")))
+	if content == "" {
+		http.Error(w, `{"error":"empty message"}`, http.StatusBadRequest)
+		return
+	}
+
+	userID, username := user.ID, user.Username
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	entry, err := appendMessage(channelID, userID, username, content, now, func(entry WALEntry) {
+		out := OutgoingChat{
+			Type:      "chat",
+			ID:        entry.ID,
+			ChannelID: channelID,
+			UserID:    userID,
+			Username:  username,
+			Content:   content,
+			CreatedAt: now,
+			Seq:       entry.Seq,
+		}
+		_ = broadcastToChannel(channelID, out, nil)
+		metricsFor(channelID).incAccepted()
+	})
+	if err != nil {
+		log.Printf("appendMessage error: %v", err)
+		http.Error(w, `{"error":"internal error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": entry.ID, "createdAt": now, "seq": entry.Seq})
+}
+
+func extractPublishContent(body []byte, contentType string) string {
+	if strings.Contains(contentType, "application/json") {
+		var payload struct {
+			Content string `json:"content"`
+		}
+		if err := json.Unmarshal(body, &payload); err == nil && payload.Content != "" {
+			return payload.Content
+		}
+	}
+	return string(body)
+}
+
+// sseSubscriber fans a channel's broadcasts out over text/event-stream.
+// Like ClientMeta's writeCh, Send is non-blocking so a slow SSE client
+// can't stall the broadcast loop; it just misses messages past the
+// buffer instead.
+type sseSubscriber struct {
+	ch   chan interface{}
+	done chan struct{}
+	once sync.Once
+}
+
+func newSSESubscriber() *sseSubscriber {
+	return &sseSubscriber{
+		ch:   make(chan interface{}, writeChBuf),
+		done: make(chan struct{}),
+	}
+}
+
+func (s *sseSubscriber) Send(msg interface{}) error {
+	select {
+	case s.ch <- msg:
+		return nil
+	case <-s.done:
+		return fmt.Errorf("subscriber closed")
+	default:
+		return fmt.Errorf("sse buffer full")
+	}
+}
+
+func (s *sseSubscriber) close() {
+	s.once.Do(func() { close(s.done) })
+}
+
+func sseHandler(w http.ResponseWriter, r *http.Request, channelID string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	sub := newSSESubscriber()
+	addSubscriber(channelID, sub)
+	defer func() {
+		removeSubscriber(channelID, sub)
+		sub.close()
+	}()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case msg := <-sub.ch:
+			data, err := json.Marshal(msg)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			flusher.Flush()
+		}
+	}
+}
+
+// pollHandler is the long-poll / plain-GET transport: return anything
+// with seq > since right away. It doesn't block waiting for new
+// messages -- callers just poll again.
+func pollHandler(w http.ResponseWriter, r *http.Request, channelID string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var since int64
+	if s := r.URL.Query().Get("since"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			http.Error(w, `{"error":"invalid since"}`, http.StatusBadRequest)
+			return
+		}
+		since = n
+	}
+
+	msgs, err := replayMessages(channelID, since)
+	if err != nil {
+		log.Printf("replayMessages error: %v", err)
+		http.Error(w, `{"error":"internal error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	resp := struct {
+		ChannelID string           `json:"channelId"`
+		Messages  []HistoryMessage `json:"messages"`
+	}{
+		ChannelID: channelID,
+		Messages:  msgs,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
 
 func wsHandler(w http.ResponseWriter, r *http.Request) {
 	token := r.URL.Query().Get("token")
@@ -359,49 +1394,45 @@ func wsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	channelID := strings.TrimSpace(channel)
-	if channelID == "" {
+	if !isValidChannelID(channelID) {
 		http.Error(w, "Invalid channel", http.StatusBadRequest)
 		return
 	}
 
+	role, err := ensureChannelMembership(channelID, user.ID)
+	if err != nil {
+		log.Printf("ensureChannelMembership error: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if role == RoleBanned {
+		http.Error(w, "banned from this channel", http.StatusForbidden)
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("upgrade error: %v", err)
 		return
 	}
+	conn.SetReadLimit(maxFrameBytes)
 
-	meta := &ClientMeta{
-		UserID:    user.ID,
-		Username:  user.Username,
-		ChannelID: channelID,
-		Conn:      conn,
-		IsAlive:   true,
-	}
+	meta := newClientMeta(user.ID, user.Username, channelID, conn, role)
 
 	// register user
 	clientsMu.Lock()
 	clients[conn] = meta
 	clientsMu.Unlock()
 
-	channelSubsMu.Lock()
-	subs := channelSubs[channelID]
-	if subs == nil {
-		subs = make(map[*websocket.Conn]struct{})
-		channelSubs[channelID] = subs
-	}
-	subs[conn] = struct{}{}
-	channelSubsMu.Unlock()
-
 	log.Printf("Client connected: user=%s channel=%s", meta.Username, meta.ChannelID)
 
-	//  mark alive on pong
+	go meta.writeLoop()
+
+	// reads get a deadline tied to the pong handler instead of relying on
+	// the heartbeat sweeper to track liveness
+	_ = conn.SetReadDeadline(time.Now().Add(pongWait))
 	conn.SetPongHandler(func(appData string) error {
-		clientsMu.Lock()
-		if m, ok := clients[conn]; ok {
-			m.IsAlive = true
-		}
-		clientsMu.Unlock()
-		return nil
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
 	})
 
 	// to send "joined" message to all
@@ -413,6 +1444,36 @@ func wsHandler(w http.ResponseWriter, r *http.Request) {
 		Username:  meta.Username,
 	}, nil)
 
+	// resume: subscribeAndReplay adds meta to channelSubs and captures
+	// the replay window as one atomic step, so nothing published in the
+	// handoff between "snapshot the WAL tail" and "start receiving live
+	// broadcast" is lost or delivered twice.
+	if sinceStr := r.URL.Query().Get("since"); sinceStr != "" {
+		since, err := strconv.ParseInt(sinceStr, 10, 64)
+		if err != nil {
+			_ = sendJSON(conn, OutgoingError{Type: "error", Message: "invalid since"})
+			addSubscriber(channelID, meta)
+		} else if missed, err := subscribeAndReplay(channelID, meta, since); err != nil {
+			log.Printf("subscribeAndReplay error: %v", err)
+			addSubscriber(channelID, meta)
+		} else {
+			for _, m := range missed {
+				_ = sendJSON(conn, OutgoingReplay{
+					Type:      "replay",
+					ID:        m.ID,
+					ChannelID: m.ChannelID,
+					UserID:    m.UserID,
+					Username:  m.Username,
+					Content:   m.Content,
+					CreatedAt: m.CreatedAt,
+					Seq:       m.Seq,
+				})
+			}
+		}
+	} else {
+		addSubscriber(channelID, meta)
+	}
+
 	go func() {
 		defer func() {
 			handleDisconnect(conn)
@@ -442,10 +1503,7 @@ func handleIncomingMessage(conn *websocket.Conn, raw []byte) {
 
 	var base IncomingBase
 	if err := json.Unmarshal(raw, &base); err != nil {
-		_ = sendJSON(conn, OutgoingError{
-			Type:    "error",
-			Message: "Invalid JSON",
-		})
+		closeWithError(meta, ProtocolError("invalid JSON frame"))
 		return
 	}
 
@@ -453,6 +1511,14 @@ func handleIncomingMessage(conn *websocket.Conn, raw []byte) {
 	case "ping":
 		_ = sendJSON(conn, OutgoingPong{Type: "pong"})
 	case "typing":
+		if meta.Role == RoleReadonly {
+			_ = sendJSON(conn, OutgoingError{Type: "error", Message: "readonly members cannot post"})
+			return
+		}
+		if !meta.typingLimiter.allow() {
+			rejectRateLimited(meta, conn, typingRatePerSec, true)
+			return
+		}
 		var msg IncomingTyping
 		if err := json.Unmarshal(raw, &msg); err != nil {
 			_ = sendJSON(conn, OutgoingError{
@@ -468,8 +1534,21 @@ func handleIncomingMessage(conn *websocket.Conn, raw []byte) {
 			Username:  meta.Username,
 			IsTyping:  msg.IsTyping,
 		}
-		_ = broadcastToChannel(meta.ChannelID, out, conn) 
+		_ = broadcastToChannel(meta.ChannelID, out, meta)
+		metricsFor(meta.ChannelID).incAccepted()
 	case "chat":
+		if meta.Role == RoleReadonly {
+			_ = sendJSON(conn, OutgoingError{Type: "error", Message: "readonly members cannot post"})
+			return
+		}
+		if !meta.chatLimiter.allow() {
+			rejectRateLimited(meta, conn, chatRatePerSec, true)
+			return
+		}
+		if !channelPublishLimiter(meta.ChannelID).allow() {
+			rejectRateLimited(meta, conn, channelPublishRate, false)
+			return
+		}
 		var msg IncomingChat
 		if err := json.Unmarshal(raw, &msg); err != nil {
 			_ = sendJSON(conn, OutgoingError{
@@ -488,26 +1567,55 @@ func handleIncomingMessage(conn *websocket.Conn, raw []byte) {
 		}
 
 		now := time.Now().UTC().Format(time.RFC3339Nano)
-		id, err := insertMessage(meta.ChannelID, meta.UserID, meta.Username, content, now)
+		_, err := appendMessage(meta.ChannelID, meta.UserID, meta.Username, content, now, func(entry WALEntry) {
+			out := OutgoingChat{
+				Type:      "chat",
+				ID:        entry.ID,
+				ChannelID: meta.ChannelID,
+				UserID:    meta.UserID,
+				Username:  meta.Username,
+				Content:   content,
+				CreatedAt: now,
+				Seq:       entry.Seq,
+			}
+			_ = broadcastToChannel(meta.ChannelID, out, nil)
+			metricsFor(meta.ChannelID).incAccepted()
+		})
 		if err != nil {
-			log.Printf("insertMessage error: %v", err)
+			log.Printf("appendMessage error: %v", err)
 			_ = sendJSON(conn, OutgoingError{
 				Type:    "error",
 				Message: "Failed to persist message",
 			})
 			return
 		}
+	case "kick", "ban":
+		if meta.Role != RoleOwner {
+			closeWithError(meta, UserError("only the channel owner can do that"))
+			return
+		}
+		var mod IncomingModeration
+		if err := json.Unmarshal(raw, &mod); err != nil || mod.TargetUserID == "" {
+			_ = sendJSON(conn, OutgoingError{Type: "error", Message: "Invalid kick/ban message"})
+			return
+		}
+		if mod.TargetUserID == meta.UserID {
+			_ = sendJSON(conn, OutgoingError{Type: "error", Message: "cannot kick/ban yourself"})
+			return
+		}
 
-		out := OutgoingChat{
-			Type:      "chat",
-			ID:        id,
-			ChannelID: meta.ChannelID,
-			UserID:    meta.UserID,
-			Username:  meta.Username,
-			Content:   content,
-			CreatedAt: now,
+		target := findClientInChannel(meta.ChannelID, mod.TargetUserID)
+		if base.Type == "ban" {
+			if err := setChannelRole(meta.ChannelID, mod.TargetUserID, RoleBanned); err != nil {
+				log.Printf("setChannelRole error: %v", err)
+				_ = sendJSON(conn, OutgoingError{Type: "error", Message: "Failed to ban user"})
+				return
+			}
+		}
+		if target == nil {
+			return // not currently connected, nothing more to do
 		}
-		_ = broadcastToChannel(meta.ChannelID, out, nil)
+		closeWithError(target, KickError(fmt.Sprintf("removed from channel by %s", meta.Username)))
 	default:
 		_ = sendJSON(conn, OutgoingError{
 			Type:    "error",
@@ -516,6 +1624,19 @@ func handleIncomingMessage(conn *websocket.Conn, raw []byte) {
 	}
 }
 
+// findClientInChannel returns the connected client for userID in
+// channelID, or nil if they aren't currently connected.
+func findClientInChannel(channelID, userID string) *ClientMeta {
+	clientsMu.RLock()
+	defer clientsMu.RUnlock()
+	for _, m := range clients {
+		if m.ChannelID == channelID && m.UserID == userID {
+			return m
+		}
+	}
+	return nil
+}
+
 func handleDisconnect(conn *websocket.Conn) {
 	clientsMu.Lock()
 	meta, ok := clients[conn]
@@ -526,16 +1647,9 @@ func handleDisconnect(conn *websocket.Conn) {
 	delete(clients, conn)
 	clientsMu.Unlock()
 
-	channelSubsMu.Lock()
-	if subs, ok := channelSubs[meta.ChannelID]; ok {
-		delete(subs, conn)
-		if len(subs) == 0 {
-			delete(channelSubs, meta.ChannelID)
-		}
-	}
-	channelSubsMu.Unlock()
+	removeSubscriber(meta.ChannelID, meta)
 
-	_ = conn.Close()
+	meta.close()
 
 	log.Printf("Client disconnected: user=%s channel=%s", meta.Username, meta.ChannelID)
 
@@ -546,7 +1660,7 @@ func handleDisconnect(conn *websocket.Conn) {
 		ChannelID: meta.ChannelID,
 		UserID:    meta.UserID,
 		Username:  meta.Username,
-	}, conn)
+	}, meta)
 }
 
 
@@ -557,11 +1671,7 @@ func sendJSON(conn *websocket.Conn, msg interface{}) error {
 	if !ok {
 		return fmt.Errorf("conn not found")
 	}
-
-	meta.WriteMu.Lock()
-	defer meta.WriteMu.Unlock()
-
-	return conn.WriteJSON(msg)
+	return meta.Send(msg)
 }
 
 func sendPing(conn *websocket.Conn) error {
@@ -572,31 +1682,35 @@ func sendPing(conn *websocket.Conn) error {
 		return fmt.Errorf("conn not found")
 	}
 
-	meta.WriteMu.Lock()
-	defer meta.WriteMu.Unlock()
-
-	deadline := time.Now().Add(5 * time.Second)
-	return conn.WriteControl(websocket.PingMessage, []byte{}, deadline)
+	select {
+	case meta.pingCh <- struct{}{}:
+		return nil
+	case <-meta.done:
+		return fmt.Errorf("client closed")
+	default:
+		// a ping is already queued, skip rather than pile up
+		return nil
+	}
 }
 
 // to write everyone except self
-func broadcastToChannel(channelID string, message interface{}, skip *websocket.Conn) error {
+func broadcastToChannel(channelID string, message interface{}, skip Subscriber) error {
 	channelSubsMu.RLock()
 	subs, ok := channelSubs[channelID]
 	if !ok || len(subs) == 0 {
 		channelSubsMu.RUnlock()
 		return nil
 	}
-	conns := make([]*websocket.Conn, 0, len(subs))
-	for c := range subs {
-		if c != skip {
-			conns = append(conns, c)
+	targets := make([]Subscriber, 0, len(subs))
+	for s := range subs {
+		if s != skip {
+			targets = append(targets, s)
 		}
 	}
 	channelSubsMu.RUnlock()
 
-	for _, c := range conns {
-		if err := sendJSON(c, message); err != nil {
+	for _, s := range targets {
+		if err := s.Send(message); err != nil {
 			log.Printf("broadcast error to channel=%s: %v", channelID, err)
 		}
 	}
@@ -606,29 +1720,23 @@ func broadcastToChannel(channelID string, message interface{}, skip *websocket.C
 
 
 func startHeartbeat() {
-	ticker := time.NewTicker(30 * time.Second)
+	ticker := time.NewTicker(pingPeriod)
 	go func() {
 		for range ticker.C {
 			var toPing []*websocket.Conn
-			var toClose []*websocket.Conn
-
-			clientsMu.Lock()
-			for c, meta := range clients {
-				if !meta.IsAlive {
-					toClose = append(toClose, c)
-				} else {
-					meta.IsAlive = false
-					toPing = append(toPing, c)
-				}
+
+			clientsMu.RLock()
+			for c := range clients {
+				toPing = append(toPing, c)
 			}
-			clientsMu.Unlock()
+			clientsMu.RUnlock()
 
+			// read-deadline resets happen in the pong handler now; a
+			// client that never pongs just has its read deadline expire
+			// and its reader goroutine exits on its own.
 			for _, c := range toPing {
 				_ = sendPing(c)
 			}
-			for _, c := range toClose {
-				_ = c.Close()
-			}
 		}
 	}()
 }
@@ -637,10 +1745,12 @@ func startHeartbeat() {
 func main() {
 	initDB()
 	startHeartbeat()
+	startChannelReaper()
 
 	http.HandleFunc("/login", loginHandler)
-	http.HandleFunc("/channels/", historyHandler)
+	http.HandleFunc("/channels/", channelsHandler)
 	http.HandleFunc("/ws", wsHandler)
+	http.HandleFunc("/metrics", metricsHandler)
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -8,23 +8,44 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"runtime"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
-	"github.com/gorilla/websocket"
+
+	"github.com/wantedbear007/battle-of-sockets/client"
+)
+
+const (
+	baseURL     = "http://localhost:3001"
+	channelName = "general"
 )
 
+// sustained: steady traffic from a fixed pool of connections for a
+// fixed duration, exercising heartbeat + broadcast fan-out at scale.
+const (
+	sustainedClients  = 200
+	sustainedDuration = 20 * time.Second
+	sustainedMsgRate  = 2.0 // chat messages per second, per client
+)
 
+// typing-bursts: clients flip isTyping on/off in rapid bursts, which
+// fans out to everyone else in the channel but never touches SQLite/WAL.
+const (
+	typingClients    = 100
+	typingDuration   = 15 * time.Second
+	typingBurstSize  = 5
+	typingBurstEvery = 2 * time.Second
+)
 
+// kill-reconnect: sustained traffic, but a fraction of clients get their
+// socket yanked out from under them partway through and have to
+// reconnect via the client package's own backoff.
 const (
-	// server url 
-	baseURL      = "http://localhost:3001" 
-	// total clients 
-	totalClients = 10000       
-	// login requests          
-	maxInFlight  = 2000    
-	channelName  = "general"              
+	killReconnectClients  = 100
+	killReconnectDuration = 20 * time.Second
+	killReconnectMsgRate  = 1.0
+	killReconnectFraction = 0.2
 )
 
 type loginResponse struct {
@@ -33,111 +54,245 @@ type loginResponse struct {
 	Username string `json:"username"`
 }
 
-func main() {
-	fmt.Printf("Server:       %s\n", baseURL)
-	fmt.Printf("Clients:      %d\n", totalClients)
-	fmt.Printf("MaxInFlight:  %d\n", maxInFlight)
-	fmt.Printf("Channel:      %s\n\n", channelName)
+// chatPayload is just enough of the server's OutgoingChat to measure
+// end-to-end receive latency against CreatedAt.
+type chatPayload struct {
+	CreatedAt string `json:"createdAt"`
+}
+
+// scenarioResult is what every scenario reports: traffic counters plus
+// a histogram of end-to-end receive latency (publish time vs wall clock
+// at the sampling subscriber).
+type scenarioResult struct {
+	clients     int
+	duration    time.Duration
+	sent        int64
+	received    int64
+	errors      int64
+	rateLimited int64
+	reconnects  int64
+	latencies   []time.Duration
+}
 
+// errorPayload is enough of the server's error frame to tell a
+// channel-wide rate_limited rejection apart from other error types.
+type errorPayload struct {
+	Message string `json:"message"`
+}
+
+func main() {
 	u, err := url.Parse(baseURL)
 	if err != nil {
 		panic(err)
 	}
 
-	// only Concurrent
-	fmt.Println("Test 1: Concurrent")
-	runtime.GOMAXPROCS(1)
-	runLoad(u)
+	scenarios := []struct {
+		name string
+		run  func(*url.URL) scenarioResult
+	}{
+		{"sustained", sustainedScenario},
+		{"typing-bursts", typingBurstScenario},
+		{"kill-reconnect", killReconnectScenario},
+	}
 
-	// Concurrent + parallel
-	fmt.Println("\nTest 2: Concurrent + parallel")
-	runtime.GOMAXPROCS(runtime.NumCPU())
-	runLoad(u)
+	for _, s := range scenarios {
+		fmt.Printf("\n=== Scenario: %s ===\n", s.name)
+		res := s.run(u)
+		printReport(s.name, res)
+	}
 }
 
+// sustainedScenario dials sustainedClients connections and has each of
+// them publish chat at sustainedMsgRate for sustainedDuration. That's
+// sustainedClients*sustainedMsgRate msgs/sec offered into one channel,
+// which is well above CHANNEL_PUBLISH_RATE_PER_SEC's default of 50/s --
+// the server is expected to reject most of it, and RateLimited in the
+// report (not Sent) is what to read as the channel-wide cap biting.
+// Latency is only measured over what actually got broadcast.
+func sustainedScenario(base *url.URL) scenarioResult {
+	res := scenarioResult{clients: sustainedClients, duration: sustainedDuration}
+	var mu sync.Mutex
 
-// core load testing 
-func runLoad(base *url.URL) {
-	start := time.Now()
+	clients := dialClients(base, sustainedClients, &res, &mu)
+	defer closeAll(clients)
 
-	var success int64
-	var failed int64
+	deadline := time.Now().Add(sustainedDuration)
+	interval := time.Duration(float64(time.Second) / sustainedMsgRate)
 
 	var wg sync.WaitGroup
-	wg.Add(totalClients)
+	for i, c := range clients {
+		wg.Add(1)
+		go func(i int, c *client.Client) {
+			defer wg.Done()
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for time.Now().Before(deadline) {
+				<-ticker.C
+				if err := c.SendChat(fmt.Sprintf("load msg from client-%d", i)); err != nil {
+					atomic.AddInt64(&res.errors, 1)
+					continue
+				}
+				atomic.AddInt64(&res.sent, 1)
+			}
+		}(i, c)
+	}
+	wg.Wait()
 
-	// Semaphore to avoid too many simultaneous dials/logins
-	sem := make(chan struct{}, maxInFlight)
+	// give in-flight broadcasts a moment to land before we stop counting
+	time.Sleep(2 * time.Second)
+	return res
+}
 
-	for i := 0; i < totalClients; i++ {
-		i := i
-		go func() {
-			defer wg.Done()
-			sem <- struct{}{}         // acquire
-			defer func() { <-sem }() // release
+// typingBurstScenario has every client fire bursts of typing events
+// rather than chat, which never touches persistence and stresses pure
+// broadcast fan-out.
+func typingBurstScenario(base *url.URL) scenarioResult {
+	res := scenarioResult{clients: typingClients, duration: typingDuration}
+	var mu sync.Mutex
 
-			if err := connectOneClient(i, base); err != nil {
-				atomic.AddInt64(&failed, 1)
-				fmt.Fprintf(os.Stderr, "client %d error: %v\n", i, err)
-				return
+	clients := dialClients(base, typingClients, &res, &mu)
+	defer closeAll(clients)
+
+	deadline := time.Now().Add(typingDuration)
+
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c *client.Client) {
+			defer wg.Done()
+			ticker := time.NewTicker(typingBurstEvery)
+			defer ticker.Stop()
+			for time.Now().Before(deadline) {
+				<-ticker.C
+				for i := 0; i < typingBurstSize; i++ {
+					isTyping := i%2 == 0
+					if err := c.SendTyping(isTyping); err != nil {
+						atomic.AddInt64(&res.errors, 1)
+						continue
+					}
+					atomic.AddInt64(&res.sent, 1)
+				}
 			}
-			atomic.AddInt64(&success, 1)
-		}()
+		}(c)
 	}
-
 	wg.Wait()
-	elapsed := time.Since(start)
-
-	fmt.Println("----- Result -----")
-	fmt.Printf("Total clients:        %d\n", totalClients)
-	fmt.Printf("Successful:           %d\n", success)
-	fmt.Printf("Failed:               %d\n", failed)
-	fmt.Printf("Total time:           %s\n", elapsed)
-	fmt.Printf("Avg per client:       %s\n", time.Duration(int64(elapsed)/int64(totalClients)))
+
+	time.Sleep(2 * time.Second)
+	return res
 }
 
+// killReconnectScenario runs sustained-style traffic, but halfway
+// through forces a fraction of clients to drop and reconnect, so the
+// backoff/resubscribe path in the client package gets exercised under
+// real broadcast load.
+func killReconnectScenario(base *url.URL) scenarioResult {
+	res := scenarioResult{clients: killReconnectClients, duration: killReconnectDuration}
+	var mu sync.Mutex
 
-// connectOneClient 
-// POST req /login
-// WS connect
-// send one chat message
-// close
-func connectOneClient(idx int, base *url.URL) error {
-	httpClient := &http.Client{
-		Timeout: 10 * time.Second,
-	}
+	clients := dialClients(base, killReconnectClients, &res, &mu)
+	defer closeAll(clients)
 
-	username := fmt.Sprintf("user-%d", idx)
+	deadline := time.Now().Add(killReconnectDuration)
+	interval := time.Duration(float64(time.Second) / killReconnectMsgRate)
+	toKill := int(float64(len(clients)) * killReconnectFraction)
 
-	// Login
-	lr, err := doLogin(httpClient, base, username)
-	if err != nil {
-		return fmt.Errorf("login failed for %s: %w", username, err)
+	var wg sync.WaitGroup
+	for i, c := range clients {
+		wg.Add(1)
+		go func(i int, c *client.Client) {
+			defer wg.Done()
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for time.Now().Before(deadline) {
+				<-ticker.C
+				if err := c.SendChat(fmt.Sprintf("load msg from client-%d", i)); err != nil {
+					atomic.AddInt64(&res.errors, 1)
+					continue
+				}
+				atomic.AddInt64(&res.sent, 1)
+			}
+		}(i, c)
 	}
 
-	// WebSocket connect
-	wsURL := makeWSURL(base, lr.Token, channelName)
-	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
-	if err != nil {
-		return fmt.Errorf("ws dial failed for %s: %w", username, err)
-	}
-	defer conn.Close()
+	// kill a subset of connections partway through, staggered so they
+	// don't all redial in the same instant
+	go func() {
+		time.Sleep(killReconnectDuration / 2)
+		for i := 0; i < toKill; i++ {
+			clients[i].ForceReconnect()
+			atomic.AddInt64(&res.reconnects, 1)
+			time.Sleep(50 * time.Millisecond)
+		}
+	}()
 
-	// Send a simple chat message
-	msg := map[string]any{
-		"type":    "chat",
-		"content": fmt.Sprintf("hello from %s", username),
-	}
+	wg.Wait()
+	time.Sleep(2 * time.Second)
+	return res
+}
+
+// dialClients logs in and dials n clients, each wired to sample receive
+// latency on chat broadcasts into res/mu.
+func dialClients(base *url.URL, n int, res *scenarioResult, mu *sync.Mutex) []*client.Client {
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+	clients := make([]*client.Client, 0, n)
+
+	for i := 0; i < n; i++ {
+		username := fmt.Sprintf("loadtest-%d-%d", time.Now().UnixNano(), i)
+		lr, err := doLogin(httpClient, base, username)
+		if err != nil {
+			atomic.AddInt64(&res.errors, 1)
+			fmt.Fprintf(os.Stderr, "login failed for %s: %v\n", username, err)
+			continue
+		}
+
+		c, err := client.Dial(makeWSURL(base, lr.Token, channelName), client.Config{})
+		if err != nil {
+			atomic.AddInt64(&res.errors, 1)
+			fmt.Fprintf(os.Stderr, "dial failed for %s: %v\n", username, err)
+			continue
+		}
+
+		c.OnMessage(func(msg client.Message) {
+			if msg.Type == "error" {
+				var payload errorPayload
+				if err := json.Unmarshal(msg.Raw, &payload); err == nil && payload.Message == "rate_limited" {
+					atomic.AddInt64(&res.rateLimited, 1)
+				}
+				return
+			}
+			if msg.Type != "chat" {
+				return
+			}
+			atomic.AddInt64(&res.received, 1)
+
+			var payload chatPayload
+			if err := json.Unmarshal(msg.Raw, &payload); err != nil {
+				return
+			}
+			createdAt, err := time.Parse(time.RFC3339Nano, payload.CreatedAt)
+			if err != nil {
+				return
+			}
+			latency := time.Since(createdAt)
 
-	if err := conn.WriteJSON(msg); err != nil {
-		return fmt.Errorf("write chat failed for %s: %w", username, err)
+			mu.Lock()
+			res.latencies = append(res.latencies, latency)
+			mu.Unlock()
+		})
+
+		clients = append(clients, c)
 	}
 
-	return nil
+	return clients
 }
 
+func closeAll(clients []*client.Client) {
+	for _, c := range clients {
+		_ = c.Close()
+	}
+}
 
-func doLogin(client *http.Client, base *url.URL, username string) (loginResponse, error) {
+func doLogin(httpClient *http.Client, base *url.URL, username string) (loginResponse, error) {
 	loginURL := base.ResolveReference(&url.URL{Path: "/login"})
 
 	payload := map[string]string{"username": username}
@@ -152,7 +307,7 @@ func doLogin(client *http.Client, base *url.URL, username string) (loginResponse
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := client.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return loginResponse{}, fmt.Errorf("login request: %w", err)
 	}
@@ -186,3 +341,38 @@ func makeWSURL(base *url.URL, token, channel string) string {
 	wsURL.RawQuery = q.Encode()
 	return wsURL.String()
 }
+
+func printReport(name string, res scenarioResult) {
+	fmt.Printf("Clients:      %d\n", res.clients)
+	fmt.Printf("Duration:     %s\n", res.duration)
+	fmt.Printf("Sent:         %d\n", res.sent)
+	fmt.Printf("Received:     %d\n", res.received)
+	fmt.Printf("RateLimited:  %d\n", res.rateLimited)
+	fmt.Printf("Errors:       %d\n", res.errors)
+	fmt.Printf("Reconnects:   %d\n", res.reconnects)
+
+	if len(res.latencies) == 0 {
+		fmt.Println("Latency:      no samples")
+		return
+	}
+
+	sort.Slice(res.latencies, func(i, j int) bool { return res.latencies[i] < res.latencies[j] })
+	p50 := percentile(res.latencies, 50)
+	p95 := percentile(res.latencies, 95)
+	p99 := percentile(res.latencies, 99)
+	fmt.Printf("Latency p50:  %s\n", p50)
+	fmt.Printf("Latency p95:  %s\n", p95)
+	fmt.Printf("Latency p99:  %s\n", p99)
+}
+
+// percentile expects sorted durations.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := (p * len(sorted)) / 100
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return sorted[idx]
+}